@@ -0,0 +1,180 @@
+//
+// PEP 691 JSON representation of the simple index, and the content
+// negotiation that picks it over the legacy PEP 503 HTML
+//
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// the only api-version the mirror understands, per PEP 691
+const simpleAPIVersion = "1.0"
+
+// one file entry shared by the HTML and JSON project page renderers
+type fileEntry struct {
+	Filename       string
+	Path           string // URL path under /packages/, as stored in file.url
+	Size           int64
+	RequiresPython *string
+	SHA256         string
+	MetadataSHA256 *string // PEP 658 sidecar digest, nil if none is available
+}
+
+// fetchProjectNames returns every project name known to the mirror, for the index page.
+func fetchProjectNames() ([]string, error) {
+	rows, err := db.Query("select name from package order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// fetchProjectFiles returns the project's last_serial and its files,
+// falling back to the upstream index if the project isn't known locally
+// yet. Files that aren't on disk are still listed (packagesHandler fetches
+// them from upstream lazily on first download) unless -cache-only is set,
+// in which case a file the mirror can never serve is pointless to list.
+func fetchProjectFiles(project string) (int64, []fileEntry, error) {
+	var lastSerial int64
+	err := db.QueryRow("select last_serial from package where name=?", project).Scan(&lastSerial)
+	if err != nil {
+		if fetchErr := fetchUpstreamProject(project); fetchErr != nil {
+			return 0, nil, fetchErr
+		}
+		if err = db.QueryRow("select last_serial from package where name=?", project).Scan(&lastSerial); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	rows, err := db.Query("select filename,url,size,requires_python,sha256_digest from file where name=?", project)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var files []fileEntry
+	filesMissing := 0
+	for rows.Next() {
+		var filename, fileURL, sha256Digest string
+		var size int64
+		var requiresPython *string
+		if err := rows.Scan(&filename, &fileURL, &size, &requiresPython, &sha256Digest); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		u, _ := url.Parse(fileURL)
+		if *cacheOnly && !fileExists(path.Join(*directory, u.Path)) {
+			filesMissing++
+			continue
+		}
+
+		files = append(files, fileEntry{
+			Filename:       filename,
+			Path:           u.Path,
+			Size:           size,
+			RequiresPython: requiresPython,
+			SHA256:         sha256Digest,
+			MetadataSHA256: ensureMetadataSidecar(filename, u.Path),
+		})
+	}
+
+	log.Printf("project %s : last_serial=%d files=%d ignored=%d\n", project, lastSerial, len(files), filesMissing)
+	return lastSerial, files, nil
+}
+
+// wantsJSON decides, from the Accept header, whether the client wants the
+// PEP 691 JSON representation rather than the legacy HTML one. The first
+// recognized media type in the header wins, as pip and "pip index" both
+// send an ordered, unambiguous Accept list.
+func wantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		switch strings.TrimSpace(strings.SplitN(part, ";", 2)[0]) {
+		case "application/vnd.pypi.simple.v1+json":
+			return true
+		case "application/vnd.pypi.simple.v1+html", "text/html", "*/*", "":
+			return false
+		}
+	}
+	return false
+}
+
+type jsonMeta struct {
+	APIVersion string `json:"api-version"`
+}
+
+type jsonProjectItem struct {
+	Name string `json:"name"`
+}
+
+type jsonIndex struct {
+	Meta     jsonMeta          `json:"meta"`
+	Projects []jsonProjectItem `json:"projects"`
+}
+
+type jsonFile struct {
+	Filename       string            `json:"filename"`
+	URL            string            `json:"url"`
+	Hashes         map[string]string `json:"hashes"`
+	RequiresPython *string           `json:"requires-python,omitempty"`
+	Size           int64             `json:"size"`
+	CoreMetadata   map[string]string `json:"core-metadata,omitempty"`
+}
+
+type jsonProject struct {
+	Meta  jsonMeta   `json:"meta"`
+	Name  string     `json:"name"`
+	Files []jsonFile `json:"files"`
+}
+
+func writeIndexJSON(w http.ResponseWriter, names []string) {
+	projects := make([]jsonProjectItem, len(names))
+	for i, name := range names {
+		projects[i] = jsonProjectItem{Name: canonicalizeName(name)}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
+	if err := json.NewEncoder(w).Encode(jsonIndex{Meta: jsonMeta{APIVersion: simpleAPIVersion}, Projects: projects}); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeProjectJSON(w http.ResponseWriter, project string, lastSerial int64, files []fileEntry) {
+	out := make([]jsonFile, len(files))
+	for i, f := range files {
+		out[i] = jsonFile{
+			Filename:       f.Filename,
+			URL:            "../.." + f.Path,
+			Hashes:         map[string]string{"sha256": f.SHA256},
+			RequiresPython: f.RequiresPython,
+			Size:           f.Size,
+		}
+		if f.MetadataSHA256 != nil {
+			out[i].CoreMetadata = map[string]string{"sha256": *f.MetadataSHA256}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
+	w.Header().Set("X-PyPI-Last-Serial", strconv.FormatInt(lastSerial, 10))
+	if err := json.NewEncoder(w).Encode(jsonProject{Meta: jsonMeta{APIVersion: simpleAPIVersion}, Name: project, Files: out}); err != nil {
+		log.Println(err)
+	}
+}
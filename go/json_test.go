@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pip (and "pip index") send this Accept header
+const pipAccept = "application/vnd.pypi.simple.v1+json, application/vnd.pypi.simple.v1+html;q=0.1, text/html;q=0.01"
+
+func TestWantsJSON(t *testing.T) {
+	cases := []struct {
+		accept string
+		want   bool
+	}{
+		{pipAccept, true},
+		{"application/vnd.pypi.simple.v1+html, text/html;q=0.01", false},
+		{"text/html", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/simple/foo/", nil)
+		r.Header.Set("Accept", c.accept)
+		if got := wantsJSON(r); got != c.want {
+			t.Errorf("wantsJSON(%q) = %v, want %v", c.accept, got, c.want)
+		}
+	}
+}
+
+func TestWriteProjectJSON(t *testing.T) {
+	requiresPython := ">=3.8"
+	files := []fileEntry{
+		{
+			Filename:       "foo-1.0-py3-none-any.whl",
+			Path:           "/packages/fo/o/foo-1.0-py3-none-any.whl",
+			Size:           1234,
+			RequiresPython: &requiresPython,
+			SHA256:         "deadbeef",
+		},
+	}
+
+	w := httptest.NewRecorder()
+	writeProjectJSON(w, "foo", 42, files)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.pypi.simple.v1+json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	var got jsonProject
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if got.Meta.APIVersion != simpleAPIVersion {
+		t.Errorf("meta.api-version = %q, want %q", got.Meta.APIVersion, simpleAPIVersion)
+	}
+	if got.Name != "foo" {
+		t.Errorf("name = %q, want %q", got.Name, "foo")
+	}
+	if len(got.Files) != 1 {
+		t.Fatalf("files = %d entries, want 1", len(got.Files))
+	}
+	if got.Files[0].Hashes["sha256"] != "deadbeef" {
+		t.Errorf("files[0].hashes.sha256 = %q, want %q", got.Files[0].Hashes["sha256"], "deadbeef")
+	}
+}
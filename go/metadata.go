@@ -0,0 +1,205 @@
+//
+// PEP 658 metadata sidecars ("<filename>.metadata"), extracted from wheels
+// and sdists so resolvers can skip downloading the full artifact
+//
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// run a full metadata-extraction pass over every file at startup, instead
+// of only extracting lazily on first request
+var extractMetadataFlag *bool
+
+// filenames currently being extracted in the background, so a burst of
+// requests for the same not-yet-cached file doesn't spawn duplicate work
+var extractingMetadata sync.Map
+
+// ensureMetadataSchema creates the table caching each file's metadata
+// sidecar digest so it isn't recomputed on every request. An empty
+// sha256_digest is a negative-cache entry: extraction was tried and the
+// file carries no usable METADATA/PKG-INFO.
+func ensureMetadataSchema() {
+	db.Exec("create table if not exists file_metadata(filename text primary key, sha256_digest text not null)")
+}
+
+// ensureMetadataSidecar returns the cached sha256 of filename's PEP 658
+// metadata sidecar, or nil if none is cached yet or none is available.
+// A cache miss kicks off a background extraction so the project page
+// response never blocks on opening a wheel/sdist; the sidecar becomes
+// available on a subsequent request once extraction completes.
+func ensureMetadataSidecar(filename, urlPath string) *string {
+	digest, cached := lookupMetadataCache(filename)
+	if cached {
+		return digest
+	}
+
+	if _, inFlight := extractingMetadata.LoadOrStore(filename, struct{}{}); !inFlight {
+		go func() {
+			defer extractingMetadata.Delete(filename)
+			extractAndCacheMetadata(filename, urlPath)
+		}()
+	}
+	return nil
+}
+
+// lookupMetadataCache reports whether filename has a cached result
+// (positive or negative) and, if so, its sidecar digest.
+func lookupMetadataCache(filename string) (*string, bool) {
+	var digest string
+	if err := db.QueryRow("select sha256_digest from file_metadata where filename=?", filename).Scan(&digest); err != nil {
+		return nil, false
+	}
+	if digest == "" {
+		return nil, true
+	}
+	return &digest, true
+}
+
+// extractAndCacheMetadata extracts filename's metadata sidecar (or reuses
+// one already on disk) and stores its digest in file_metadata, including a
+// negative-cache entry when the artifact is present but carries no usable
+// METADATA/PKG-INFO, so that case is never re-scanned. An artifact that
+// isn't downloaded yet (the normal state for a proxied-but-not-yet-fetched
+// file) is left uncached entirely, so it's retried once it appears.
+func extractAndCacheMetadata(filename, urlPath string) {
+	fp := filepath.Join(*directory, urlPath)
+	if !fileExists(fp) {
+		return
+	}
+	sidecarPath := fp + ".metadata"
+
+	var data []byte
+	var err error
+	if fileExists(sidecarPath) {
+		data, err = os.ReadFile(sidecarPath)
+	} else {
+		data, err = extractMetadata(fp)
+		if err == nil {
+			err = os.WriteFile(sidecarPath, data, 0644)
+		}
+	}
+
+	digest := ""
+	if err != nil {
+		log.Printf("metadata extraction for %s: %v", filename, err)
+	} else {
+		sum := sha256.Sum256(data)
+		digest = hex.EncodeToString(sum[:])
+	}
+
+	if _, err := db.Exec("insert or replace into file_metadata(filename, sha256_digest) values(?, ?)", filename, digest); err != nil {
+		log.Println(err)
+	}
+}
+
+// extractMetadata pulls METADATA (wheel) or PKG-INFO (sdist) out of the
+// archive at fp.
+func extractMetadata(fp string) ([]byte, error) {
+	switch {
+	case strings.HasSuffix(fp, ".whl"):
+		return extractWheelMetadata(fp)
+	case strings.HasSuffix(fp, ".tar.gz"), strings.HasSuffix(fp, ".tgz"):
+		return extractSdistMetadata(fp)
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", fp)
+	}
+}
+
+func extractWheelMetadata(fp string) ([]byte, error) {
+	zr, err := zip.OpenReader(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, ".dist-info/METADATA") {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+	}
+	return nil, fmt.Errorf("no METADATA found in %s", fp)
+}
+
+func extractSdistMetadata(fp string) ([]byte, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(hdr.Name, "/PKG-INFO") {
+			return io.ReadAll(tr)
+		}
+	}
+	return nil, fmt.Errorf("no PKG-INFO found in %s", fp)
+}
+
+// extractAllMetadata is the -extract-metadata startup pass: walk every
+// known file and make sure its sidecar exists, instead of waiting for the
+// first request to need it.
+func extractAllMetadata() {
+	rows, err := db.Query("select filename, url from file")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	type job struct{ filename, fileURL string }
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.filename, &j.fileURL); err != nil {
+			log.Println(err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+
+	for _, j := range jobs {
+		if _, cached := lookupMetadataCache(j.filename); cached {
+			continue
+		}
+		u, err := url.Parse(j.fileURL)
+		if err != nil {
+			continue
+		}
+		extractAndCacheMetadata(j.filename, u.Path)
+	}
+	log.Printf("metadata extraction pass: processed %d files\n", len(jobs))
+}
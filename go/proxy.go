@@ -0,0 +1,201 @@
+//
+// upstream caching proxy: fetch project metadata and files from a real
+// PyPI index on demand when they are missing from the local mirror
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// base URL of the upstream index queried for projects/files the mirror
+// does not have yet, e.g. https://pypi.org
+var upstream *string
+
+// never reach out to upstream, only serve what is already cached locally
+var cacheOnly *bool
+
+// how long to remember that upstream has no such project, so repeated
+// requests for a typo'd or removed project don't hammer it
+var negativeCacheTTL *time.Duration
+
+// project name -> time after which it may be looked up upstream again
+var negativeCache sync.Map
+
+func negativeCached(project string) bool {
+	expiry, ok := negativeCache.Load(project)
+	return ok && time.Now().Before(expiry.(time.Time))
+}
+
+func negativeCacheStore(project string) {
+	if *negativeCacheTTL > 0 {
+		negativeCache.Store(project, time.Now().Add(*negativeCacheTTL))
+	}
+}
+
+// the subset of the PyPI JSON API (https://warehouse.pypa.io/api-reference/json.html)
+// that the mirror needs in order to populate its own tables
+type upstreamFile struct {
+	Filename       string `json:"filename"`
+	URL            string `json:"url"`
+	Size           int64  `json:"size"`
+	RequiresPython string `json:"requires_python"`
+	Digests        struct {
+		SHA256 string `json:"sha256"`
+	} `json:"digests"`
+}
+
+type upstreamProject struct {
+	LastSerial int64                     `json:"last_serial"`
+	Releases   map[string][]upstreamFile `json:"releases"`
+}
+
+// fetchUpstreamProject queries the upstream JSON API for project and, on
+// success, upserts its releases into the package and file tables so that
+// the regular simpleProject code path can serve them straight away.
+func fetchUpstreamProject(project string) error {
+	if *cacheOnly {
+		return errors.New("cache-only mode: not querying upstream")
+	}
+	if negativeCached(project) {
+		return errors.New("project negatively cached")
+	}
+
+	resp, err := http.Get(*upstream + "/pypi/" + project + "/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		negativeCacheStore(project)
+		return fmt.Errorf("project %s not found upstream", project)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned %s for project %s", resp.Status, project)
+	}
+
+	var p upstreamProject
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("insert or replace into package(name, last_serial) values(?, ?)", project, p.LastSerial)
+	if err != nil {
+		return err
+	}
+
+	for release, files := range p.Releases {
+		for _, f := range files {
+			// store just the path, the same as simpleProject/fetchProjectFiles
+			// expect and emit as the href; fetchUpstreamFile resolves it back
+			// to an absolute upstream URL when it needs to download it
+			u, err := url.Parse(f.URL)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`insert or replace into file(name, release, filename, url, size, requires_python, sha256_digest)
+				values(?, ?, ?, ?, ?, ?, ?)`,
+				project, release, f.Filename, u.Path, f.Size, f.RequiresPython, f.Digests.SHA256)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// fetchUpstreamFile downloads the file served at urlPath (the same path
+// stored in file.url and emitted as the href in simpleProject) from
+// upstream, checks its sha256 against the digest recorded in the file
+// table, and atomically writes it under *directory.
+func fetchUpstreamFile(urlPath string) error {
+	if *cacheOnly {
+		return errors.New("cache-only mode: not fetching upstream file")
+	}
+
+	var fileURL, sha256Digest string
+	err := db.QueryRow("select url, sha256_digest from file where url=?", urlPath).Scan(&fileURL, &sha256Digest)
+	if err != nil {
+		return fmt.Errorf("unknown file %s: %w", urlPath, err)
+	}
+
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		fileURL = "https://files.pythonhosted.org" + fileURL
+	}
+
+	resp, err := http.Get(fileURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned %s for %s", resp.Status, fileURL)
+	}
+
+	fp := filepath.Join(*directory, urlPath)
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fp), ".pypim-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != sha256Digest {
+		return fmt.Errorf("sha256 mismatch for %s: got %s, want %s", urlPath, digest, sha256Digest)
+	}
+
+	return os.Rename(tmp.Name(), fp)
+}
+
+// packagesHandler serves *directory like http.FileServer, fetching the
+// file from upstream first if it isn't on disk yet.
+func packagesHandler(w http.ResponseWriter, r *http.Request) {
+	fp := filepath.Join(*directory, r.URL.Path)
+	if !fileExists(fp) {
+		if err := fetchUpstreamFile(r.URL.Path); err != nil {
+			log.Println(err)
+			http.NotFound(w, r)
+			return
+		}
+	}
+	http.FileServer(http.Dir(*directory)).ServeHTTP(w, r)
+}
@@ -14,7 +14,6 @@ import (
 	"html"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/user"
 	"path"
@@ -23,6 +22,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -68,8 +68,25 @@ func fileExists(f string) bool {
 	return err == nil
 }
 
-// returns the project list
-func simpleIndex(w http.ResponseWriter) {
+// returns the project list, as HTML (PEP 503) or JSON (PEP 691) depending
+// on the request's Accept header
+func simpleIndex(w http.ResponseWriter, r *http.Request) {
+	names, err := fetchProjectNames()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeIndexJSON(w, names)
+	} else {
+		writeIndexHTML(w, names)
+	}
+}
+
+func writeIndexHTML(w http.ResponseWriter, names []string) {
+	w.Header().Set("Content-Type", "text/html")
 
 	fmt.Fprint(w, `<!DOCTYPE html>
 <html>
@@ -79,14 +96,7 @@ func simpleIndex(w http.ResponseWriter) {
   <body>
 `)
 
-	rows, _ := db.Query("select name from package order by name")
-	defer rows.Close()
-	for rows.Next() {
-		var name string
-		err := rows.Scan(&name)
-		if err != nil {
-			log.Fatal(err)
-		}
+	for _, name := range names {
 		fmt.Fprintf(w, "    <a href=\"./%s\">%s</a><br/>\n", canonicalizeName(name), name)
 	}
 
@@ -95,22 +105,26 @@ func simpleIndex(w http.ResponseWriter) {
 `)
 }
 
-// gets the files list for the given project
-func simpleProject(w http.ResponseWriter, project string) {
-
-	// verify if we have the project by fetching its last_serial
-	var lastSerial int64
-	err := db.QueryRow("select last_serial from package where name=?", project).Scan(&lastSerial)
+// gets the files list for the given project, as HTML (PEP 503) or JSON
+// (PEP 691) depending on the request's Accept header
+func simpleProject(w http.ResponseWriter, r *http.Request, project string) {
+	lastSerial, files, err := fetchProjectFiles(project)
 	if err != nil {
-		log.Printf("project %s not found", project)
+		log.Printf("project %s not found (%v)", project, err)
 		w.WriteHeader(403)
 		return
 	}
 
-	filesCount := 0
-	filesMissing := 0
+	if wantsJSON(r) {
+		writeProjectJSON(w, project, lastSerial, files)
+	} else {
+		writeProjectHTML(w, project, lastSerial, files)
+	}
+}
+
+func writeProjectHTML(w http.ResponseWriter, project string, lastSerial int64, files []fileEntry) {
+	w.Header().Set("Content-Type", "text/html")
 
-	// build the html page with file list
 	fmt.Fprintf(w, `<!DOCTYPE html>
 <html>
   <head>
@@ -120,42 +134,20 @@ func simpleProject(w http.ResponseWriter, project string) {
 	<h1>Links for %s</h1>
 `, project, project)
 
-	rows, _ := db.Query("select release,filename,url,size,requires_python,sha256_digest from file where name=?", project)
-	defer rows.Close()
-	for rows.Next() {
-		var release string
-		var filename string
-		var fileURL string
-		var size int64
-		var requiresPython *string
-		var sha256Digest string
-		err := rows.Scan(&release, &filename, &fileURL, &size, &requiresPython, &sha256Digest)
-		if err != nil {
-			log.Println(err)
-		} else {
-			u, _ := url.Parse(fileURL)
-
-			fp := path.Join(*directory, u.Path)
-			if fileExists(fp) {
-				params := ""
-				if requiresPython != nil {
-					params = " data-requires-python=\"" + html.EscapeString(*requiresPython) + "\""
-				}
-				fmt.Fprintf(w, "    <a href=\"../..%s#sha256=%s\"%s>%s</a><br/>\n", u.Path, sha256Digest, params, filename)
-
-				filesCount++
-			} else {
-				filesMissing++
-			}
-
+	for _, f := range files {
+		params := ""
+		if f.RequiresPython != nil {
+			params += " data-requires-python=\"" + html.EscapeString(*f.RequiresPython) + "\""
 		}
+		if f.MetadataSHA256 != nil {
+			params += " data-core-metadata=\"sha256=" + *f.MetadataSHA256 + "\""
+		}
+		fmt.Fprintf(w, "    <a href=\"../..%s#sha256=%s\"%s>%s</a><br/>\n", f.Path, f.SHA256, params, f.Filename)
 	}
 
 	fmt.Fprintf(w, `  </body>
 </html>
 <!--SERIAL {%d}-->`, lastSerial)
-
-	log.Printf("project %s : last_serial=%d files=%d ignored=%d\n", project, lastSerial, filesCount, filesMissing)
 }
 
 func simple(w http.ResponseWriter, r *http.Request) {
@@ -165,9 +157,9 @@ func simple(w http.ResponseWriter, r *http.Request) {
 	path := strings.Split(r.URL.Path, "/")
 
 	if path[2] == "" {
-		simpleIndex(w)
+		simpleIndex(w, r)
 	} else {
-		simpleProject(w, canonicalizeName(path[2]))
+		simpleProject(w, r, canonicalizeName(path[2]))
 	}
 }
 
@@ -195,6 +187,13 @@ func main() {
 	port := flag.Int("p", 8000, "port to serve on")
 	directory = flag.String("r", "~/data/pypi", "mirror root directory")
 	secure := flag.Bool("secure", false, "use https")
+	upstream = flag.String("upstream", "https://pypi.org", "upstream index queried for projects/files missing locally")
+	cacheOnly = flag.Bool("cache-only", false, "never query upstream, serve only what is already cached")
+	negativeCacheTTL = flag.Duration("negative-cache-ttl", 10*time.Minute, "how long to remember that upstream has no such project")
+	htpasswd = flag.String("htpasswd", "", "path to an htpasswd-style (bcrypt) file gating /legacy/ uploads; uploads are disabled if empty")
+	extractMetadataFlag = flag.Bool("extract-metadata", false, "extract PEP 658 metadata sidecars for every known file at startup")
+	lameDuck = flag.Duration("lame-duck", 2*time.Minute, "how long to let in-flight requests finish before forcing shutdown on SIGINT/SIGTERM")
+	accessLogPath = flag.String("access", "", "path to a Combined Log Format access log; disabled if empty")
 	flag.Parse()
 
 	*directory = getPath(*directory)
@@ -206,26 +205,54 @@ func main() {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	ensureUploadSchema()
+	ensureMetadataSchema()
+	if *extractMetadataFlag {
+		extractAllMetadata()
+	}
 
-	http.Handle("/packages/", http.FileServer(http.Dir(*directory)))
+	http.HandleFunc("/packages/", packagesHandler)
 	http.HandleFunc("/simple/", simple)
+	if *htpasswd != "" {
+		users, err := loadHtpasswd(*htpasswd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		uploadUsers = users
+		http.HandleFunc("/legacy/", upload)
+		http.HandleFunc("/pypi/", upload)
+	}
 	http.HandleFunc("/", defaultHandle)
 
+	var handler http.Handler = http.DefaultServeMux
+	if *accessLogPath != "" {
+		accessLog, err := os.OpenFile(*accessLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer accessLog.Close()
+		handler = accessLogMiddleware(accessLog, handler)
+	}
+
 	addr := ":" + strconv.Itoa(*port)
+	srv := &http.Server{Addr: addr, Handler: handler}
 
+	certFile, keyFile := "", ""
 	if *secure {
-		/* create a self-signed certificate (https://stackoverflow.com/questions/10175812/)
-
-		openssl req -x509 -newkey rsa:4096 -sha256 -days 3650 -nodes \
-			-keyout server.key -out server.crt -subj /CN=localhost
-		*/
-
+		certFile, keyFile = "server.crt", "server.key"
+		if exe, err := os.Executable(); err == nil {
+			certFile = filepath.Join(filepath.Dir(exe), certFile)
+			keyFile = filepath.Join(filepath.Dir(exe), keyFile)
+		}
+		if err := ensureSelfSignedCert(certFile, keyFile); err != nil {
+			log.Fatal(err)
+		}
 		log.Printf("Serving %s on HTTPS port: %d", *directory, *port)
-		log.Fatal(http.ListenAndServeTLS(addr, "server.crt", "server.key", nil))
-
 	} else {
-
 		log.Printf("Serving %s on HTTP port: %d", *directory, *port)
-		log.Fatal(http.ListenAndServe(addr, nil))
+	}
+
+	if err := serve(srv, certFile, keyFile); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,113 @@
+//
+// automatic self-signed TLS bootstrap for -secure, so LAN clients using
+// --trusted-host don't need a manual openssl step
+//
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// ensureSelfSignedCert makes sure certFile/keyFile exist, generating a
+// self-signed ECDSA P-256 certificate for the machine's hostname and
+// outbound IPs if they don't. The pair is persisted next to the binary
+// and reused across restarts.
+func ensureSelfSignedCert(certFile, keyFile string) error {
+	if fileExists(certFile) && fileExists(keyFile) {
+		return nil
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	// derive a deterministic serial number from the public key, rather than
+	// keeping a separate counter around; RFC 5280 caps serialNumber at 20
+	// octets, and the high bit must be clear to keep the DER encoding positive
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(pub)
+	serialBytes := append([]byte(nil), sum[:20]...)
+	serialBytes[0] &= 0x7F
+	serial := new(big.Int).SetBytes(serialBytes)
+
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil {
+		dnsNames = append(dnsNames, hostname)
+	}
+	ipAddresses := append([]net.IP{net.ParseIP("127.0.0.1")}, outboundIPs()...)
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              dnsNames,
+		IPAddresses:           ipAddresses,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+
+	certOut, err := os.Create(certFile)
+	if err != nil {
+		return err
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return err
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	keyOut, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}); err != nil {
+		return err
+	}
+
+	log.Printf("generated self-signed certificate %s for %v %v", certFile, dnsNames, ipAddresses)
+	return nil
+}
+
+// outboundIPs enumerates the machine's outbound IP addresses via the usual
+// UDP dial trick: dialing "udp" never sends a packet, it just asks the
+// kernel to pick the local address it would use to reach the sentinel.
+func outboundIPs() []net.IP {
+	var ips []net.IP
+	for _, sentinel := range []string{"8.8.8.8:80"} {
+		conn, err := net.Dial("udp", sentinel)
+		if err != nil {
+			continue
+		}
+		ips = append(ips, conn.LocalAddr().(*net.UDPAddr).IP)
+		conn.Close()
+	}
+	return ips
+}
@@ -0,0 +1,213 @@
+//
+// legacy PEP 503 upload API (aka "/legacy/" or "/pypi/"), as spoken by
+// "twine upload", for hosting private packages alongside the mirror
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// path to an htpasswd-style file (bcrypt hashes only) gating /legacy/ uploads;
+// uploads are disabled when empty
+var htpasswd *string
+
+// username -> bcrypt hash, loaded once from *htpasswd at startup
+var uploadUsers map[string]string
+
+// ensureUploadSchema adds the columns the upload endpoint needs to the
+// existing package table. The alter fails harmlessly once the column
+// exists, so its error is ignored.
+func ensureUploadSchema() {
+	db.Exec("alter table package add column private integer not null default 0")
+}
+
+// loadHtpasswd parses an htpasswd-style file ("user:bcrypt-hash" per line).
+func loadHtpasswd(f string) (map[string]string, error) {
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if found {
+			users[user] = hash
+		}
+	}
+	return users, nil
+}
+
+func checkUploadAuth(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := uploadUsers[user]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// packagesURLPath builds the /packages/ URL for filename the way
+// simpleProject expects to find it: two levels of two-character hash
+// buckets, mirroring PyPI's own layout.
+func packagesURLPath(filename string) string {
+	sum := sha256.Sum256([]byte(filename))
+	hexSum := hex.EncodeToString(sum[:])
+	return "/packages/" + hexSum[0:2] + "/" + hexSum[2:4] + "/" + hexSum[4:] + "/" + filename
+}
+
+// upload handles "twine upload", storing the artifact under *directory and
+// registering it in the package/file tables as a private package.
+func upload(w http.ResponseWriter, r *http.Request) {
+	if !checkUploadAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pypim upload"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(128 << 20); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	name := canonicalizeName(r.FormValue("name"))
+	version := r.FormValue("version")
+	declaredDigest := r.FormValue("sha256_digest")
+	if declaredDigest == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "sha256_digest is required")
+		return
+	}
+
+	var requiresPython *string
+	if v := r.FormValue("requires_python"); v != "" {
+		requiresPython = &v
+	}
+
+	content, header, err := r.FormFile("content")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer content.Close()
+
+	filename := header.Filename
+
+	var count int
+	if err := db.QueryRow("select count(*) from file where filename=?", filename).Scan(&count); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%s already exists", filename)
+		return
+	}
+
+	urlPath := packagesURLPath(filename)
+	fp := filepath.Join(*directory, urlPath)
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fp), ".pypim-*")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), content)
+	tmp.Close()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != declaredDigest {
+		os.Remove(tmp.Name())
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "sha256 mismatch: got %s, declared %s", digest, declaredDigest)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), fp); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := upsertPrivatePackage(name, version, filename, urlPath, size, requiresPython, digest); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("uploaded %s (%s) : %d bytes\n", filename, name, size)
+}
+
+func upsertPrivatePackage(name, release, filename, urlPath string, size int64, requiresPython *string, sha256Digest string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lastSerial int64
+	err = tx.QueryRow("select last_serial from package where name=?", name).Scan(&lastSerial)
+	switch err {
+	case sql.ErrNoRows:
+		if _, err := tx.Exec("insert into package(name, last_serial, private) values(?, 0, 1)", name); err != nil {
+			return err
+		}
+	case nil:
+		if _, err := tx.Exec("update package set private=1 where name=?", name); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	_, err = tx.Exec(`insert into file(name, release, filename, url, size, requires_python, sha256_digest)
+		values(?, ?, ?, ?, ?, ?, ?)`, name, release, filename, urlPath, size, requiresPython, sha256Digest)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}